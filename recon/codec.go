@@ -0,0 +1,281 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+// CodecSKS, CodecMsgpack, CodecCBOR and CodecJSON name the Codec
+// implementations negotiable via the "codec" key of Config.Contents.
+const (
+	CodecSKS     = "sks"
+	CodecMsgpack = "msgpack"
+	CodecCBOR    = "cbor"
+	CodecJSON    = "json"
+)
+
+// Codec encodes and decodes ReconMsgs on the wire. It lets a session
+// speak something other than the legacy SKS binary framing, so debug
+// tools, tests and non-Go peers can drive recon without reimplementing
+// it.
+type Codec interface {
+	Encode(w io.Writer, msg ReconMsg) error
+	Decode(r io.Reader) (ReconMsg, error)
+}
+
+// codecPreference lists codecs most-to-least preferred when
+// negotiating with a peer. sks is listed last: every conflux peer
+// supports it, so it's the guaranteed fallback, not the first choice.
+var codecPreference = []string{CodecCBOR, CodecMsgpack, CodecJSON, CodecSKS}
+
+var codecs = map[string]Codec{
+	CodecSKS:     sksCodec{},
+	CodecMsgpack: &handleCodec{h: &codec.MsgpackHandle{}},
+	CodecCBOR:    &handleCodec{h: &codec.CborHandle{}},
+	CodecJSON:    &handleCodec{h: &codec.JsonHandle{}},
+}
+
+// negotiateCodec picks the highest-preference codec supported by both
+// conflux and the remote peer's advertised codec list.
+func negotiateCodec(remote string) string {
+	remoteSet := make(map[string]bool)
+	for _, name := range strings.Split(remote, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			remoteSet[name] = true
+		}
+	}
+	for _, name := range codecPreference {
+		if remoteSet[name] {
+			return name
+		}
+	}
+	return CodecSKS
+}
+
+// advertisedCodecs is the value conflux sends in the "codec" key of
+// Config.Contents during the handshake.
+func advertisedCodecs() string {
+	return strings.Join(codecPreference, ",")
+}
+
+// CodecSetter is implemented by Conns whose framing can be switched
+// mid-session, once the config handshake has negotiated a Codec.
+type CodecSetter interface {
+	SetCodec(Codec)
+}
+
+// streamCodec is implemented by Codecs that need state bound to a
+// single connection's stream, rather than being usable as-is against
+// whatever io.Writer/io.Reader happens to be passed to Encode/Decode.
+// tcpConn calls bind once, after negotiation, instead of treating the
+// negotiated Codec as stateless.
+type streamCodec interface {
+	Codec
+	bind(rw io.ReadWriter) Codec
+}
+
+// bindCodec adapts any Codec to a connection's stream: stateless
+// Codecs (sksCodec) are returned as-is, and streamCodecs are bound
+// once so they can hold per-connection state.
+func bindCodec(c Codec, rw io.ReadWriter) Codec {
+	if sc, ok := c.(streamCodec); ok {
+		return sc.bind(rw)
+	}
+	return c
+}
+
+// sksCodec preserves today's SKS-compatible binary encoding. Each
+// ReadMsg/WriteMsg call already frames a complete message on its own,
+// so sksCodec carries no per-connection state.
+type sksCodec struct{}
+
+func (sksCodec) Encode(w io.Writer, msg ReconMsg) error {
+	return WriteMsg(w, msg)
+}
+
+func (sksCodec) Decode(r io.Reader) (ReconMsg, error) {
+	return ReadMsg(r)
+}
+
+// reconMsgTag identifies a ReconMsg's concrete type across the wire,
+// independent of any Go-specific type information the codec library
+// might otherwise rely on.
+type reconMsgTag string
+
+const (
+	tagConfig        reconMsgTag = "config"
+	tagReconRqstPoly reconMsgTag = "reconRqstPoly"
+	tagReconRqstFull reconMsgTag = "reconRqstFull"
+	tagElements      reconMsgTag = "elements"
+	tagFullElements  reconMsgTag = "fullElements"
+	tagSyncFail      reconMsgTag = "syncFail"
+	tagDone          reconMsgTag = "done"
+)
+
+func tagOf(msg ReconMsg) (reconMsgTag, error) {
+	switch msg.(type) {
+	case *Config:
+		return tagConfig, nil
+	case *ReconRqstPoly:
+		return tagReconRqstPoly, nil
+	case *ReconRqstFull:
+		return tagReconRqstFull, nil
+	case *Elements:
+		return tagElements, nil
+	case *FullElements:
+		return tagFullElements, nil
+	case *SyncFail:
+		return tagSyncFail, nil
+	case *Done:
+		return tagDone, nil
+	default:
+		return "", fmt.Errorf("codec: unsupported ReconMsg %T", msg)
+	}
+}
+
+func newMsg(tag reconMsgTag) (ReconMsg, error) {
+	switch tag {
+	case tagConfig:
+		return &Config{}, nil
+	case tagReconRqstPoly:
+		return &ReconRqstPoly{}, nil
+	case tagReconRqstFull:
+		return &ReconRqstFull{}, nil
+	case tagElements:
+		return &Elements{}, nil
+	case tagFullElements:
+		return &FullElements{}, nil
+	case tagSyncFail:
+		return &SyncFail{}, nil
+	case tagDone:
+		return &Done{}, nil
+	default:
+		return nil, fmt.Errorf("codec: unknown ReconMsg tag %q", tag)
+	}
+}
+
+// handleCodec adapts a ugorji/go/codec Handle (msgpack, CBOR or JSON)
+// to Codec. All three share a single implementation since codec.Handle
+// already abstracts their wire-format differences. Each message is
+// written as its tag followed by the message value, so Decode knows
+// which concrete type to allocate before reading the value.
+//
+// handleCodec itself is only used to carry the Handle and as the
+// lookup value in the codecs registry; bind produces the
+// connCodec that actually encodes/decodes.
+//
+// NOTE: this file has no round-trip test yet. Writing one means
+// building a *Config, *Elements, etc. and sending it through a bound
+// connCodec, but none of the ReconMsg types (Config, ReconRqstPoly,
+// ReconRqstFull, Elements, FullElements, SyncFail, Done) are defined
+// anywhere in this tree, only referenced from peer.go as if they
+// exist. A real test needs those types first, which is the same gap
+// blocking Bitstring/ZSet marshaling (see the TODO in zp.go) — msgpack
+// and CBOR will reach ugorji's reflection-based encoding for both with
+// no defined wire format until then.
+type handleCodec struct {
+	h codec.Handle
+}
+
+func (c *handleCodec) bind(rw io.ReadWriter) Codec {
+	return &connCodec{
+		enc: codec.NewEncoder(rw, c.h),
+		dec: codec.NewDecoder(rw, c.h),
+	}
+}
+
+// Encode and Decode exist so handleCodec satisfies Codec (e.g. before
+// bind is called), but a long-running TCP session must go through bind
+// instead of calling these directly: ugorji's Decoder buffers ahead of
+// the current value for non-length-prefixed formats, so a fresh
+// Decoder per call can discard bytes that belonged to the next
+// message.
+func (c *handleCodec) Encode(w io.Writer, msg ReconMsg) error {
+	return c.bind(readWriter{w: w}).Encode(w, msg)
+}
+
+func (c *handleCodec) Decode(r io.Reader) (ReconMsg, error) {
+	return c.bind(readWriter{r: r}).Decode(r)
+}
+
+// connCodec holds the Encoder/Decoder bound to one connection's
+// stream for its whole session, so values aren't lost to read-ahead
+// buffering between messages.
+type connCodec struct {
+	enc *codec.Encoder
+	dec *codec.Decoder
+}
+
+func (c *connCodec) bind(rw io.ReadWriter) Codec { return c }
+
+func (c *connCodec) Encode(_ io.Writer, msg ReconMsg) error {
+	tag, err := tagOf(msg)
+	if err != nil {
+		return err
+	}
+	if err := c.enc.Encode(tag); err != nil {
+		return err
+	}
+	return c.enc.Encode(msg)
+}
+
+func (c *connCodec) Decode(_ io.Reader) (ReconMsg, error) {
+	var tag reconMsgTag
+	if err := c.dec.Decode(&tag); err != nil {
+		return nil, err
+	}
+	msg, err := newMsg(tag)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.dec.Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// readWriter adapts a lone io.Reader or io.Writer to io.ReadWriter for
+// the one-shot fallback path in handleCodec.Encode/Decode above.
+type readWriter struct {
+	r io.Reader
+	w io.Writer
+}
+
+func (rw readWriter) Read(p []byte) (int, error) {
+	if rw.r == nil {
+		return 0, io.EOF
+	}
+	return rw.r.Read(p)
+}
+
+func (rw readWriter) Write(p []byte) (int, error) {
+	if rw.w == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return rw.w.Write(p)
+}
@@ -22,13 +22,15 @@
 package recon
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	. "github.com/cmars/conflux"
-	"io"
 	"log"
 	"net"
 	"time"
+
+	"golang.org/x/sync/errgroup"
 )
 
 const SERVE = "serve:"
@@ -47,10 +49,6 @@ type RecoverChan chan *Recover
 
 var PNodeNotFound error = errors.New("Prefix-tree node not found")
 
-type serverEnable chan bool
-type gossipEnable chan bool
-type stopped chan interface{}
-
 type reconCmd func() error
 
 type reconCmdReq chan reconCmd
@@ -62,23 +60,39 @@ type Peer struct {
 	RecoverChan  RecoverChan
 	reconCmdReq  reconCmdReq
 	reconCmdResp reconCmdResp
-	serverEnable serverEnable
-	gossipEnable gossipEnable
-	stopped      stopped
+	transport    Transport
+	ctx          context.Context
+	cancel       context.CancelFunc
+	eg           *errgroup.Group
+	listening    chan struct{}
 }
 
-func NewPeer(settings *Settings, tree PrefixTree) *Peer {
+func NewPeer(settings *Settings, tree PrefixTree) (*Peer, error) {
+	transport, err := NewTransport(settings)
+	if err != nil {
+		return nil, err
+	}
 	return &Peer{
 		RecoverChan: make(RecoverChan),
 		Settings:    settings,
-		PrefixTree:  tree}
+		PrefixTree:  tree,
+		transport:   transport,
+		ctx:         context.Background()}, nil
 }
 
+// NewMemPeer constructs a Peer with default, in-memory Settings. The
+// default transport is tcp, which never fails to construct, so the
+// NewPeer error is only a programming error here (e.g. an invalid
+// built-in default) and is safe to panic on.
 func NewMemPeer() *Peer {
 	settings := NewSettings()
 	tree := new(MemPrefixTree)
 	tree.Init()
-	return NewPeer(settings, tree)
+	peer, err := NewPeer(settings, tree)
+	if err != nil {
+		panic(err)
+	}
+	return peer
 }
 
 func (p *Peer) log(v ...interface{}) {
@@ -86,113 +100,219 @@ func (p *Peer) log(v ...interface{}) {
 	log.Println(v...)
 }
 
+// Start launches the server, gossip and command-handling goroutines
+// under a root context that Stop cancels.
 func (p *Peer) Start() {
-	p.serverEnable = make(serverEnable)
-	p.gossipEnable = make(gossipEnable)
-	p.stopped = make(stopped)
+	ctx, cancel := context.WithCancel(context.Background())
+	eg, ctx := errgroup.WithContext(ctx)
+	p.ctx = ctx
+	p.cancel = cancel
+	p.eg = eg
+	p.listening = make(chan struct{})
 	p.reconCmdReq = make(reconCmdReq)
 	p.reconCmdResp = make(reconCmdResp)
-	go p.Serve()
-	go p.Gossip()
-	go p.handleCmds()
+	eg.Go(func() error { return p.Serve(ctx) })
+	eg.Go(func() error { return p.Gossip(ctx) })
+	eg.Go(func() error { p.handleCmds(ctx); return nil })
 }
 
+// WaitListening blocks until Serve's transport has bound its listening
+// endpoint, or ctx is done. Start spawns Serve on its own goroutine, so
+// without this a caller that dials immediately after Start races the
+// listener.
+func (p *Peer) WaitListening(ctx context.Context) error {
+	select {
+	case <-p.listening:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop cancels the root context and waits for Serve, Gossip and
+// handleCmds to return before releasing the peer's channels.
 func (p *Peer) Stop() {
-	if p.serverEnable == nil {
+	if p.cancel == nil {
 		p.log(SERVE, "Stop: peer not running")
 		return
 	}
 	p.log(SERVE, "Stopping")
-	go func() { p.serverEnable <- false }()
-	go func() { p.gossipEnable <- false }()
-	// Drain recovery channel
-	go func() {
-		for _ = range p.RecoverChan {
-		}
-	}()
-	<-p.stopped
-	<-p.stopped
-	close(p.stopped)
+	p.cancel()
+	if err := p.eg.Wait(); err != nil && err != context.Canceled {
+		p.log(SERVE, err)
+	}
 	close(p.reconCmdReq)
 	close(p.reconCmdResp)
 	close(p.RecoverChan)
-	p.serverEnable = nil
-	p.gossipEnable = nil
-	p.stopped = nil
+	p.cancel = nil
+	p.eg = nil
+	p.ctx = context.Background()
 	p.reconCmdReq = nil
 	p.reconCmdResp = nil
 	p.RecoverChan = nil
 	p.log(SERVE, "Stopped")
 }
 
+// Gossip periodically dials every partner through p.transport to
+// exchange updates. Cancelling ctx ends the gossip loop so Stop's
+// errgroup.Wait can return.
+func (p *Peer) Gossip(ctx context.Context) error {
+	ticker := time.NewTicker(p.GossipIntervalDuration())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			for _, addr := range p.PartnerAddrs() {
+				if err := p.gossipWith(ctx, addr); err != nil {
+					p.log(SERVE, "gossip with", addr, ":", err)
+				}
+			}
+		}
+	}
+}
+
+// gossipWith dials addr, runs the client side of the config/codec
+// handshake that accept runs for incoming connections, and then drives
+// the same interactWithClient reconciliation loop.
+func (p *Peer) gossipWith(ctx context.Context, addr string) error {
+	conn, err := p.transport.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	sessionCtx, cancel := context.WithTimeout(ctx, p.ReconTimeout)
+	defer cancel()
+	stopWatch := closeOnDone(sessionCtx, conn)
+	defer stopWatch()
+
+	ourConfig := p.Config()
+	ourConfig["codec"] = advertisedCodecs()
+	if err := conn.WriteMsg(&Config{Contents: ourConfig}); err != nil {
+		return err
+	}
+	msg, err := conn.ReadMsg()
+	if err != nil {
+		return err
+	}
+	remoteConfig, is := msg.(*Config)
+	if !is {
+		return errors.New(fmt.Sprintf("Expected remote config, got: %v", remoteConfig))
+	}
+	p.log(SERVE, "gossip remote config:", remoteConfig)
+	if cs, ok := conn.(CodecSetter); ok {
+		negotiated := negotiateCodec(remoteConfig.Contents["codec"])
+		p.log(SERVE, "negotiated codec:", negotiated)
+		cs.SetCodec(codecs[negotiated])
+	}
+	return p.ExecCmd(sessionCtx, func() error {
+		return p.interactWithClient(sessionCtx, conn, remoteConfig.Contents, NewBitstring(0))
+	})
+}
+
 // handleCmds executes recon cmds in a single goroutine.
 // This forces sequential reads and writes to the prefix
 // tree.
-func (p *Peer) handleCmds() {
+func (p *Peer) handleCmds(ctx context.Context) {
 	for {
 		select {
 		case cmd, ok := <-p.reconCmdReq:
 			if !ok {
 				return
 			}
-			p.reconCmdResp <- cmd()
+			select {
+			case p.reconCmdResp <- cmd():
+			case <-ctx.Done():
+				return
+			}
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func (p *Peer) ExecCmd(cmd reconCmd) (err error) {
-	p.reconCmdReq <- cmd
-	err = <-p.reconCmdResp
+func (p *Peer) ExecCmd(ctx context.Context, cmd reconCmd) (err error) {
+	select {
+	case p.reconCmdReq <- cmd:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err = <-p.reconCmdResp:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	return
 }
 
 func (p *Peer) Insert(z *Zp) (err error) {
-	return p.ExecCmd(func() error {
+	return p.ExecCmd(p.ctx, func() error {
 		return p.PrefixTree.Insert(z)
 	})
 }
 
 func (p *Peer) Remove(z *Zp) (err error) {
-	return p.ExecCmd(func() error {
+	return p.ExecCmd(p.ctx, func() error {
 		return p.PrefixTree.Remove(z)
 	})
 }
 
-func (p *Peer) Serve() {
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p.ReconPort))
-	if err != nil {
-		log.Print(err)
-		return
+// Serve accepts recon sessions until ctx is cancelled, handing each
+// off to accept with a per-session deadline derived from Settings.
+func (p *Peer) Serve(ctx context.Context) error {
+	if err := p.transport.Listen(); err != nil {
+		return err
 	}
-	defer ln.Close()
-	for {
-		select {
-		case enabled, isOpen := <-p.serverEnable:
-			if !enabled || !isOpen {
-				close(p.serverEnable)
-				p.stopped <- true
+	defer p.transport.Close()
+	close(p.listening)
+	// Accept runs on its own goroutine so that ctx cancellation (rather
+	// than polling a listener deadline) is what unblocks it, regardless
+	// of which Transport is in use.
+	conns := make(chan Conn)
+	go func() {
+		for {
+			conn, err := p.transport.Accept()
+			if err != nil {
+				close(conns)
+				return
+			}
+			select {
+			case conns <- conn:
+			case <-ctx.Done():
+				conn.Close()
 				return
 			}
-		default:
-		}
-		ln.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second * 5))
-		conn, err := ln.Accept()
-		if err != nil {
-			p.log(SERVE, err)
-			continue
 		}
-		err = p.accept(conn)
-		if err != nil {
-			p.log(SERVE, err)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case conn, isOpen := <-conns:
+			if !isOpen {
+				return nil
+			}
+			if err := p.accept(ctx, conn); err != nil {
+				p.log(SERVE, err)
+			}
 		}
 	}
 }
 
-func (p *Peer) accept(conn net.Conn) error {
+func (p *Peer) accept(ctx context.Context, conn Conn) error {
 	defer conn.Close()
 	p.log(SERVE, "connection from:", conn.RemoteAddr())
+	sessionCtx, cancel := context.WithTimeout(ctx, p.ReconTimeout)
+	defer cancel()
+	// conn.ReadMsg below blocks on the underlying socket and knows
+	// nothing about sessionCtx; closeOnDone closes conn as soon as the
+	// session is cancelled or times out so a stalled remote can't wedge
+	// Stop's errgroup.Wait.
+	stopWatch := closeOnDone(sessionCtx, conn)
+	defer stopWatch()
 	// Read remote config from gossip client
-	msg, err := ReadMsg(conn)
+	msg, err := conn.ReadMsg()
 	if err != nil {
 		return err
 	}
@@ -200,15 +320,21 @@ func (p *Peer) accept(conn net.Conn) error {
 	if !is {
 		return errors.New(fmt.Sprintf("Expected remote config, got: %v", remoteConfig))
 	}
-	// Respond with our config
-	err = WriteMsg(conn, &Config{Contents: p.Config()})
+	// Respond with our config, advertising the codecs we can speak
+	ourConfig := p.Config()
+	ourConfig["codec"] = advertisedCodecs()
+	err = conn.WriteMsg(&Config{Contents: ourConfig})
 	if err != nil {
 		return err
 	}
 	p.log(SERVE, "remote config:", remoteConfig)
-	conn.SetDeadline(time.Now().Add(time.Second))
-	return p.ExecCmd(func() error {
-		return p.interactWithClient(conn, remoteConfig.Contents, NewBitstring(0))
+	if cs, ok := conn.(CodecSetter); ok {
+		negotiated := negotiateCodec(remoteConfig.Contents["codec"])
+		p.log(SERVE, "negotiated codec:", negotiated)
+		cs.SetCodec(codecs[negotiated])
+	}
+	return p.ExecCmd(sessionCtx, func() error {
+		return p.interactWithClient(sessionCtx, conn, remoteConfig.Contents, NewBitstring(0))
 	})
 }
 
@@ -261,7 +387,7 @@ type reconWithClient struct {
 	bottomQ  []*bottomEntry
 	rcvrSet  *ZSet
 	flushing bool
-	conn     net.Conn
+	conn     Conn
 }
 
 func (rwc *reconWithClient) pushBottom(bottom *bottomEntry) {
@@ -301,17 +427,45 @@ func (rwc *reconWithClient) isDone() bool {
 	return len(rwc.requestQ) == 0 && len(rwc.bottomQ) == 0
 }
 
-// TODO: need to send error back on chan as well
-func readAllMsgs(r io.Reader) chan ReconMsg {
-	c := make(chan ReconMsg)
+// closeOnDone closes conn as soon as ctx is cancelled, so a blocked
+// conn.ReadMsg (which does not itself know about ctx) is interrupted
+// instead of wedging its caller past Stop. The returned stop func must
+// be called once the session using conn is finished, so a ctx that
+// outlives the session doesn't close conn out from under its caller.
+func closeOnDone(ctx context.Context, conn Conn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// msgOrErr pairs a ReconMsg with any error encountered reading it, so
+// a read failure reaches interactWithClient instead of silently
+// closing the channel out from under it.
+type msgOrErr struct {
+	msg ReconMsg
+	err error
+}
+
+func readAllMsgs(ctx context.Context, conn Conn) chan msgOrErr {
+	c := make(chan msgOrErr)
 	go func() {
+		defer close(c)
 		for {
-			msg, err := ReadMsg(r)
+			msg, err := conn.ReadMsg()
+			select {
+			case c <- msgOrErr{msg: msg, err: err}:
+			case <-ctx.Done():
+				return
+			}
 			if err != nil {
-				close(c)
 				return
 			}
-			c <- msg
 		}
 	}()
 	return c
@@ -330,7 +484,7 @@ func (rwc *reconWithClient) sendRequest(p *Peer, req *requestEntry) {
 			Samples: req.node.SValues()}
 	}
 	p.log(SERVE, "sendRequest:", msg)
-	WriteMsg(rwc.conn, msg)
+	rwc.conn.WriteMsg(msg)
 	rwc.pushBottom(&bottomEntry{requestEntry: req})
 }
 
@@ -354,7 +508,7 @@ func (rwc *reconWithClient) handleReply(p *Peer, msg ReconMsg, req *requestEntry
 		remotediff := ZSetDiff(m.ZSet, local)
 		elementsMsg := &Elements{ZSet: localdiff}
 		p.log(SERVE, "handleReply:", "sending:", elementsMsg)
-		WriteMsg(rwc.conn, elementsMsg)
+		rwc.conn.WriteMsg(elementsMsg)
 		rwc.rcvrSet.AddAll(remotediff)
 	default:
 		err = errors.New(fmt.Sprintf("unexpected message: %v", m))
@@ -368,7 +522,7 @@ func (rwc *reconWithClient) flushQueue() {
 	rwc.flushing = true
 }
 
-func (p *Peer) interactWithClient(conn net.Conn, remoteConfig map[string]string, bitstring *Bitstring) (err error) {
+func (p *Peer) interactWithClient(ctx context.Context, conn Conn, remoteConfig map[string]string, bitstring *Bitstring) (err error) {
 	p.log(SERVE, "interacting with client")
 	recon := reconWithClient{Peer: p, conn: conn, rcvrSet: NewZSet()}
 	var root PrefixNode
@@ -377,8 +531,13 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig map[string]string,
 		return
 	}
 	recon.pushRequest(&requestEntry{node: root, key: bitstring})
-	msgChan := readAllMsgs(conn)
+	msgChan := readAllMsgs(ctx, conn)
 	for !recon.isDone() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		bottom := recon.topBottom()
 		p.log(SERVE, "interact: bottom:", bottom)
 		switch {
@@ -392,24 +551,34 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig map[string]string,
 			recon.flushing = false
 		case bottom.state == reconStateBottom:
 			p.log("Queue length:", len(recon.bottomQ))
-			var msg ReconMsg
+			var m msgOrErr
 			hasMsg := false
 			select {
-			case msg = <-msgChan:
+			case m = <-msgChan:
 				hasMsg = true
 			default:
 			}
 			if hasMsg {
+				if m.err != nil {
+					return m.err
+				}
 				recon.popBottom()
-				err = recon.handleReply(p, msg, bottom.requestEntry)
+				err = recon.handleReply(p, m.msg, bottom.requestEntry)
 			} else if len(recon.bottomQ) > p.MaxOutstandingReconRequests ||
 				len(recon.requestQ) == 0 {
 				if !recon.flushing {
 					recon.flushQueue()
 				} else {
 					recon.popBottom()
-					msg = <-msgChan
-					err = recon.handleReply(p, msg, bottom.requestEntry)
+					select {
+					case m = <-msgChan:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					if m.err != nil {
+						return m.err
+					}
+					err = recon.handleReply(p, m.msg, bottom.requestEntry)
 				}
 			} else {
 				req := recon.popRequest()
@@ -421,12 +590,16 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig map[string]string,
 		}
 	}
 	msg := &Done{}
-	WriteMsg(conn, msg)
+	conn.WriteMsg(msg)
 	items := recon.rcvrSet.Items()
 	if len(items) > 0 {
-		p.RecoverChan <- &Recover{
+		select {
+		case p.RecoverChan <- &Recover{
 			RemoteAddr:     conn.RemoteAddr(),
-			RemoteElements: items}
+			RemoteElements: items}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 	return
 }
@@ -0,0 +1,60 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// TestStopKillsPeerMidRecon starts a peer, opens a connection to it as
+// if beginning a recon session, then kills the peer with Stop before
+// the session finishes. Stop must return and leave no goroutines
+// behind, even though accept was blocked mid-handshake.
+func TestStopKillsPeerMidRecon(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	peer := NewMemPeer()
+	peer.Settings.ReconTimeout = time.Second
+	peer.Start()
+
+	if err := peer.WaitListening(context.Background()); err != nil {
+		t.Fatalf("wait listening: %v", err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", peer.Settings.ReconPort))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Leave the session mid-handshake: accept is now blocked reading
+	// the remote Config that will never arrive.
+	time.Sleep(10 * time.Millisecond)
+
+	peer.Stop()
+}
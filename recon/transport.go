@@ -0,0 +1,144 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TransportTCP and TransportZMQ name the transport implementations
+// selectable via Settings.Transport.
+const (
+	TransportTCP = "tcp"
+	TransportZMQ = "zmq"
+)
+
+var ErrUnknownTransport = errors.New("unknown transport")
+
+// Conn is a framed message connection produced by a Transport. It is
+// the unit that accept, Gossip and interactWithClient read and write
+// ReconMsgs on, regardless of what sits underneath it.
+type Conn interface {
+	ReadMsg() (ReconMsg, error)
+	WriteMsg(ReconMsg) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Transport abstracts the network layer a Peer uses to accept incoming
+// recon sessions and dial out for gossip, so that a stream-oriented
+// backend (TCP) and a message-broker-oriented backend (ZeroMQ) can be
+// used interchangeably.
+type Transport interface {
+	// Listen begins accepting sessions on the transport's configured
+	// bind endpoint.
+	Listen() error
+	// Accept blocks until a new session is available, or the listener
+	// is closed.
+	Accept() (Conn, error)
+	// Dial opens a session to the given address.
+	Dial(addr string) (Conn, error)
+	// Close releases any resources held by the transport.
+	Close() error
+}
+
+// NewTransport constructs the Transport named by the given Settings.
+func NewTransport(settings *Settings) (Transport, error) {
+	switch settings.Transport {
+	case "", TransportTCP:
+		return newTCPTransport(settings), nil
+	case TransportZMQ:
+		return newZMQTransport(settings)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownTransport, settings.Transport)
+	}
+}
+
+// tcpConn adapts a net.Conn to Conn, framing messages with a Codec
+// that defaults to the original SKS-compatible encoding until the
+// handshake negotiates another one.
+type tcpConn struct {
+	net.Conn
+	codec Codec
+}
+
+func (c *tcpConn) ReadMsg() (ReconMsg, error) {
+	return c.codec.Decode(c.Conn)
+}
+
+func (c *tcpConn) WriteMsg(msg ReconMsg) error {
+	return c.codec.Encode(c.Conn, msg)
+}
+
+// SetCodec switches the encoding used for the rest of the session, as
+// negotiated during the config handshake. The codec is bound to this
+// connection's stream once here, rather than rebuilt on every
+// ReadMsg/WriteMsg, so a streamCodec can hold the single long-lived
+// Encoder/Decoder a multi-message TCP session needs.
+func (c *tcpConn) SetCodec(codec Codec) {
+	c.codec = bindCodec(codec, c.Conn)
+}
+
+// tcpTransport is the default Transport, preserving conflux's original
+// one-connection-per-goroutine behavior over net.Listen/net.Dial.
+type tcpTransport struct {
+	settings *Settings
+	ln       net.Listener
+}
+
+func newTCPTransport(settings *Settings) *tcpTransport {
+	return &tcpTransport{settings: settings}
+}
+
+func (t *tcpTransport) Listen() error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", t.settings.ReconPort))
+	if err != nil {
+		return err
+	}
+	t.ln = ln
+	return nil
+}
+
+func (t *tcpTransport) Accept() (Conn, error) {
+	conn, err := t.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tcpConn{Conn: conn, codec: sksCodec{}}, nil
+}
+
+func (t *tcpTransport) Dial(addr string) (Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpConn{Conn: conn, codec: sksCodec{}}, nil
+}
+
+func (t *tcpTransport) Close() error {
+	if t.ln == nil {
+		return nil
+	}
+	return t.ln.Close()
+}
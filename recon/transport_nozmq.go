@@ -0,0 +1,38 @@
+// +build !zmq
+
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import "errors"
+
+// ErrZMQNotBuilt is returned by NewTransport when Settings.Transport
+// selects zmq but this binary was built without the "zmq" build tag,
+// which pulls in cgo/CZMQ bindings most deployments don't need.
+var ErrZMQNotBuilt = errors.New("recon: zmq transport requires building with -tags zmq")
+
+// newZMQTransport is stubbed out here so that the recon package
+// builds (and the tcp Transport works) without the zmq build tag.
+// transport_zmq.go provides the real implementation under that tag.
+func newZMQTransport(settings *Settings) (Transport, error) {
+	return nil, ErrZMQNotBuilt
+}
@@ -0,0 +1,273 @@
+// +build zmq
+
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (C) 2012  Casey Marshall <casey.marshall@gmail.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// zmqAddr satisfies net.Addr for a ZeroMQ ROUTER peer identity, since
+// ROUTER/DEALER sockets have no per-session net.Conn to ask.
+type zmqAddr string
+
+func (a zmqAddr) Network() string { return "zmq" }
+func (a zmqAddr) String() string  { return string(a) }
+
+// zmqConn is one logical recon session multiplexed over a shared
+// ROUTER socket. Reads are fed by the transport's single receive loop;
+// writes are serialized onto the socket with the session's identity
+// frame prepended.
+type zmqConn struct {
+	identity []byte
+	in       chan []byte
+	out      chan<- zmqFrame
+	closed   chan struct{}
+	codec    Codec
+	remove   func()
+}
+
+type zmqFrame struct {
+	identity []byte
+	body     []byte
+}
+
+func (c *zmqConn) ReadMsg() (ReconMsg, error) {
+	select {
+	case body, ok := <-c.in:
+		if !ok {
+			return nil, io.EOF
+		}
+		return c.codec.Decode(bytes.NewReader(body))
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *zmqConn) WriteMsg(msg ReconMsg) error {
+	var buf bytes.Buffer
+	if err := c.codec.Encode(&buf, msg); err != nil {
+		return err
+	}
+	select {
+	case c.out <- zmqFrame{identity: c.identity, body: buf.Bytes()}:
+		return nil
+	case <-c.closed:
+		return io.EOF
+	}
+}
+
+func (c *zmqConn) SetCodec(codec Codec) {
+	c.codec = codec
+}
+
+func (c *zmqConn) RemoteAddr() net.Addr { return zmqAddr(c.identity) }
+
+func (c *zmqConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+		if c.remove != nil {
+			c.remove()
+		}
+	}
+	return nil
+}
+
+// zmqTransport services many concurrent recon sessions over a single
+// ROUTER socket, avoiding the one-goroutine-per-TCP-connection cost of
+// tcpTransport. Outgoing gossip sessions do not share that socket:
+// Dial opens a separate DEALER socket for each one.
+type zmqTransport struct {
+	settings *Settings
+	router   *zmq.Socket
+	accepted chan Conn
+	out      chan zmqFrame
+	closed   chan struct{}
+
+	mu    sync.Mutex
+	conns map[string]*zmqConn
+}
+
+func newZMQTransport(settings *Settings) (*zmqTransport, error) {
+	router, err := zmq.NewSocket(zmq.ROUTER)
+	if err != nil {
+		return nil, err
+	}
+	if settings.ZMQIdentity != "" {
+		if err := router.SetIdentity(settings.ZMQIdentity); err != nil {
+			return nil, err
+		}
+	}
+	if settings.ZMQHWM > 0 {
+		if err := router.SetRcvhwm(settings.ZMQHWM); err != nil {
+			return nil, err
+		}
+		if err := router.SetSndhwm(settings.ZMQHWM); err != nil {
+			return nil, err
+		}
+	}
+	return &zmqTransport{
+		settings: settings,
+		router:   router,
+		accepted: make(chan Conn),
+		out:      make(chan zmqFrame),
+		closed:   make(chan struct{}),
+		conns:    make(map[string]*zmqConn),
+	}, nil
+}
+
+func (t *zmqTransport) Listen() error {
+	if err := t.router.Bind(t.settings.ZMQBindEndpoint); err != nil {
+		return err
+	}
+	go t.recvLoop()
+	go t.sendLoop()
+	return nil
+}
+
+func (t *zmqTransport) recvLoop() {
+	for {
+		frames, err := t.router.RecvMessageBytes(0)
+		if err != nil || len(frames) < 2 {
+			return
+		}
+		identity, body := frames[0], frames[1]
+		conn, isNew := t.sessionFor(identity)
+		if isNew {
+			select {
+			case t.accepted <- conn:
+			case <-t.closed:
+				return
+			}
+		}
+		select {
+		case conn.in <- body:
+		case <-conn.closed:
+		}
+	}
+}
+
+func (t *zmqTransport) sendLoop() {
+	for frame := range t.out {
+		t.router.SendMessage(frame.identity, frame.body)
+	}
+}
+
+func (t *zmqTransport) sessionFor(identity []byte) (*zmqConn, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := string(identity)
+	conn, ok := t.conns[key]
+	if ok {
+		return conn, false
+	}
+	conn = &zmqConn{
+		identity: append([]byte(nil), identity...),
+		in:       make(chan []byte),
+		out:      t.out,
+		closed:   make(chan struct{}),
+		codec:    sksCodec{},
+	}
+	// remove lets Close drop this session from conns, so a later
+	// message from the same identity starts a fresh session instead of
+	// resolving to one that's already closed for good.
+	conn.remove = func() {
+		t.mu.Lock()
+		delete(t.conns, key)
+		t.mu.Unlock()
+	}
+	t.conns[key] = conn
+	return conn, true
+}
+
+func (t *zmqTransport) Accept() (Conn, error) {
+	conn, ok := <-t.accepted
+	if !ok {
+		return nil, fmt.Errorf("zmq transport closed")
+	}
+	return conn, nil
+}
+
+func (t *zmqTransport) Dial(addr string) (Conn, error) {
+	// A DEALER socket per outgoing gossip session keeps dialing
+	// semantics symmetric with tcpTransport.Dial, while still routing
+	// through the broker rather than a dedicated stream socket.
+	dealer, err := zmq.NewSocket(zmq.DEALER)
+	if err != nil {
+		return nil, err
+	}
+	if err := dealer.Connect(addr); err != nil {
+		dealer.Close()
+		return nil, err
+	}
+	return &zmqDialerConn{Socket: dealer, addr: addr, codec: sksCodec{}}, nil
+}
+
+func (t *zmqTransport) Close() error {
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+		close(t.accepted)
+	}
+	close(t.out)
+	return t.router.Close()
+}
+
+// zmqDialerConn is the gossip-side (DEALER) half of a ZeroMQ session.
+type zmqDialerConn struct {
+	*zmq.Socket
+	addr  string
+	codec Codec
+}
+
+func (c *zmqDialerConn) ReadMsg() (ReconMsg, error) {
+	body, err := c.Socket.RecvBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	return c.codec.Decode(bytes.NewReader(body))
+}
+
+func (c *zmqDialerConn) SetCodec(codec Codec) {
+	c.codec = codec
+}
+
+func (c *zmqDialerConn) WriteMsg(msg ReconMsg) error {
+	var buf bytes.Buffer
+	if err := c.codec.Encode(&buf, msg); err != nil {
+		return err
+	}
+	_, err := c.Socket.SendBytes(buf.Bytes(), 0)
+	return err
+}
+
+func (c *zmqDialerConn) RemoteAddr() net.Addr { return zmqAddr(c.addr) }
@@ -23,6 +23,7 @@
 package conflux
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math/big"
 )
@@ -85,3 +86,49 @@ func assertZp(x, y *Zp) {
 		panic(fmt.Sprintf("finite field mismatch betwee Z(%v) and Z(%v)", x.P, y.P))
 	}
 }
+
+// MarshalBinary encodes a Zp as its length-prefixed P and Z big.Int
+// bytes, independent of any particular wire codec, so that non-SKS
+// recon peers (msgpack, CBOR, JSON) can marshal Zp values without
+// reimplementing the legacy framing.
+func (zp *Zp) MarshalBinary() ([]byte, error) {
+	pBytes := zp.P.Bytes()
+	zBytes := zp.Z.Bytes()
+	buf := make([]byte, 4+len(pBytes)+4+len(zBytes))
+	binary.BigEndian.PutUint32(buf, uint32(len(pBytes)))
+	copy(buf[4:], pBytes)
+	offset := 4 + len(pBytes)
+	binary.BigEndian.PutUint32(buf[offset:], uint32(len(zBytes)))
+	copy(buf[offset+4:], zBytes)
+	return buf, nil
+}
+
+// UnmarshalBinary is the inverse of MarshalBinary.
+func (zp *Zp) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("Zp.UnmarshalBinary: short buffer")
+	}
+	pLen := int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if len(data) < pLen+4 {
+		return fmt.Errorf("Zp.UnmarshalBinary: short buffer")
+	}
+	pBytes := data[:pLen]
+	data = data[pLen:]
+	zLen := int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if len(data) < zLen {
+		return fmt.Errorf("Zp.UnmarshalBinary: short buffer")
+	}
+	zp.P = big.NewInt(0).SetBytes(pBytes)
+	zp.Z = big.NewInt(0).SetBytes(data[:zLen])
+	return nil
+}
+
+// TODO(codec): Bitstring and ZSet also cross the wire in ReconRqstFull,
+// Elements and FullElements, and need the same MarshalBinary/
+// UnmarshalBinary treatment as Zp above so non-SKS peers (msgpack, CBOR,
+// JSON) can decode them. Neither type is defined anywhere in this tree
+// yet (recon/peer.go already references Bitstring and ZSet as if they
+// exist), so there's nothing to hang those methods on here. Add them
+// alongside whichever file first defines Bitstring and ZSet.
@@ -52,6 +52,17 @@ func TestMinusOne(t *testing.T) {
 	assert.Equal(t, int64(65536), a.Z.Int64())
 }
 
+func TestMarshalBinaryRoundTrip(t *testing.T) {
+	a := zp7(5)
+	data, err := a.MarshalBinary()
+	assert.Equal(t, nil, err)
+	b := &Zp{}
+	err = b.UnmarshalBinary(data)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, a.P.Cmp(b.P))
+	assert.Equal(t, 0, a.Z.Cmp(b.Z))
+}
+
 func TestMismatchedP(t *testing.T) {
 	defer func(){
         r := recover()